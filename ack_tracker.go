@@ -0,0 +1,72 @@
+/*
+ * Copyright 2018 Splunk, Inc..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import "sync"
+
+// ackTracker keeps track of the Splunk HEC indexer acknowledgment IDs a
+// client is still waiting on. Each outstanding ackID maps to a channel that
+// is closed once the poller has confirmed it.
+type ackTracker struct {
+	mu      sync.Mutex
+	pending map[int64]chan struct{}
+}
+
+func newAckTracker() *ackTracker {
+	return &ackTracker{pending: make(map[int64]chan struct{})}
+}
+
+// await registers ackID as outstanding and returns a channel that is closed
+// once confirm is called with that ackID.
+func (t *ackTracker) await(ackID int64) <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	done := make(chan struct{})
+	t.pending[ackID] = done
+	return done
+}
+
+// confirm marks the given ack IDs as acknowledged, waking up any goroutine
+// blocked in await.
+func (t *ackTracker) confirm(ackIDs []int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, id := range ackIDs {
+		if done, ok := t.pending[id]; ok {
+			close(done)
+			delete(t.pending, id)
+		}
+	}
+}
+
+// forget removes an ackID without confirming it, used when a waiter gives up.
+func (t *ackTracker) forget(ackID int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.pending, ackID)
+}
+
+// outstanding returns a snapshot of the ack IDs still awaiting confirmation.
+func (t *ackTracker) outstanding() []int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ids := make([]int64, 0, len(t.pending))
+	for id := range t.pending {
+		ids = append(ids, id)
+	}
+	return ids
+}
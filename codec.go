@@ -0,0 +1,135 @@
+/*
+ * Copyright 2018 Splunk, Inc..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec wraps an io.Writer with a streaming compression format and names
+// the wire format it produces, so tryPostMessages can set Content-Encoding
+// without knowing which codec it is using.
+type Codec interface {
+	Name() string
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+}
+
+// codecForOption resolves the splunk-compression option to a Codec,
+// defaulting to the legacy splunk-gzip/splunk-gzip-level options when
+// compression is unset so existing configurations keep working.
+func codecForOption(compression string, gzipCompression bool, gzipCompressionLevel int) (Codec, error) {
+	if compression == "" {
+		if gzipCompression {
+			return gzipCodec{level: gzipCompressionLevel}, nil
+		}
+		return noneCodec{}, nil
+	}
+	switch compression {
+	case "none":
+		return noneCodec{}, nil
+	case "gzip":
+		return gzipCodec{level: gzipCompressionLevel}, nil
+	case "zstd":
+		return zstdCodec{}, nil
+	case "snappy":
+		return snappyCodec{}, nil
+	default:
+		return nil, fmt.Errorf("%s: unsupported splunk-compression value %q", driverName, compression)
+	}
+}
+
+// noneCodec passes messages through uncompressed.
+type noneCodec struct{}
+
+func (noneCodec) Name() string { return "none" }
+
+func (noneCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// gzipCodec compresses with compress/gzip, reusing gzipWriterPool when the
+// client is running at the default compression level.
+type gzipCodec struct {
+	level int
+}
+
+func (gzipCodec) Name() string { return "gzip" }
+
+func (c gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	if c.level == gzip.DefaultCompression {
+		gzipWriter := gzipWriterPool.Get().(*gzip.Writer)
+		gzipWriter.Reset(w)
+		return &pooledGzipWriter{Writer: gzipWriter}, nil
+	}
+	gzipWriter, err := gzip.NewWriterLevel(w, c.level)
+	if err != nil {
+		return nil, err
+	}
+	return gzipWriter, nil
+}
+
+// gzipWriterPool recycles *gzip.Writer instances created at
+// gzip.DefaultCompression, the level used unless an operator explicitly
+// overrides gzipCompressionLevel. Non-default levels are not pooled since
+// gzip.Writer cannot change its compression level on Reset.
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+// pooledGzipWriter returns its underlying *gzip.Writer to gzipWriterPool
+// once closed.
+type pooledGzipWriter struct {
+	*gzip.Writer
+}
+
+func (p *pooledGzipWriter) Close() error {
+	err := p.Writer.Close()
+	gzipWriterPool.Put(p.Writer)
+	return err
+}
+
+// zstdCodec compresses with github.com/klauspost/compress/zstd, trading
+// some CPU for a meaningfully better ratio than gzip on typical log payloads.
+type zstdCodec struct{}
+
+func (zstdCodec) Name() string { return "zstd" }
+
+func (zstdCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w)
+}
+
+// snappyCodec compresses with github.com/golang/snappy, trading ratio for
+// the lowest CPU overhead of the available codecs.
+type snappyCodec struct{}
+
+func (snappyCodec) Name() string { return "snappy" }
+
+func (snappyCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return snappy.NewBufferedWriter(w), nil
+}
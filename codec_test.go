@@ -0,0 +1,126 @@
+/*
+ * Copyright 2018 Splunk, Inc..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+func decompressWith(name string, compressed []byte) ([]byte, error) {
+	switch name {
+	case "none":
+		return compressed, nil
+	case "gzip":
+		r, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case "zstd":
+		r, err := zstd.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case "snappy":
+		return ioutil.ReadAll(snappy.NewReader(bytes.NewReader(compressed)))
+	default:
+		panic("decompressWith: unknown codec " + name)
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	const payload = "the quick brown fox jumps over the lazy dog"
+
+	cases := []struct {
+		name  string
+		codec Codec
+	}{
+		{"none", noneCodec{}},
+		{"gzip default level", gzipCodec{level: gzip.DefaultCompression}},
+		{"gzip explicit level", gzipCodec{level: gzip.BestSpeed}},
+		{"zstd", zstdCodec{}},
+		{"snappy", snappyCodec{}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			writer, err := c.codec.NewWriter(&buf)
+			if err != nil {
+				t.Fatalf("NewWriter failed: %v", err)
+			}
+			if _, err := writer.Write([]byte(payload)); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			got, err := decompressWith(c.codec.Name(), buf.Bytes())
+			if err != nil {
+				t.Fatalf("failed to decompress %s output: %v", c.codec.Name(), err)
+			}
+			if string(got) != payload {
+				t.Fatalf("round trip mismatch: got %q, want %q", got, payload)
+			}
+		})
+	}
+}
+
+func TestCodecForOption(t *testing.T) {
+	cases := []struct {
+		name                 string
+		compression          string
+		gzipCompression      bool
+		gzipCompressionLevel int
+		wantName             string
+		wantErr              bool
+	}{
+		{"unset falls back to gzip flag off", "", false, 0, "none", false},
+		{"unset falls back to gzip flag on", "", true, gzip.DefaultCompression, "gzip", false},
+		{"explicit none", "none", true, gzip.DefaultCompression, "none", false},
+		{"explicit gzip", "gzip", false, gzip.BestSpeed, "gzip", false},
+		{"explicit zstd", "zstd", false, 0, "zstd", false},
+		{"explicit snappy", "snappy", false, 0, "snappy", false},
+		{"unsupported value", "lz4", false, 0, "", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			codec, err := codecForOption(c.compression, c.gzipCompression, c.gzipCompressionLevel)
+			if c.wantErr {
+				if err == nil {
+					t.Fatal("expected an error for an unsupported splunk-compression value")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("codecForOption failed: %v", err)
+			}
+			if got := codec.Name(); got != c.wantName {
+				t.Fatalf("expected codec %q, got %q", c.wantName, got)
+			}
+		})
+	}
+}
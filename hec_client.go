@@ -18,15 +18,17 @@ package main
 
 import (
 	"bytes"
-	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	uuid "github.com/satori/go.uuid"
 )
 
 type hecClient struct {
@@ -38,6 +40,7 @@ type hecClient struct {
 	auth           string
 
 	// http compression
+	compression          string
 	gzipCompression      bool
 	gzipCompressionLevel int
 
@@ -45,9 +48,116 @@ type hecClient struct {
 	postMessagesFrequency time.Duration
 	postMessagesBatchSize int
 	bufferMaximum         int
+
+	// Indexer acknowledgment
+	indexAckEnabled bool
+	ackPollInterval time.Duration
+	ackTimeout      time.Duration
+
+	channelID      string
+	channelOnce    sync.Once
+	ackTracker     *ackTracker
+	ackTrackerOnce sync.Once
+	ackPollOnce    sync.Once
+
+	// On-disk overflow spool
+	spoolPath      string
+	spoolMaxBytes  int64
+	spoolInstance  *spool
+	spoolOnce      sync.Once
+	spoolReplayRun sync.Once
+
+	// Background goroutine lifecycle. closeCh is closed by Close to stop
+	// the ack poller and spool replay loop; both are only ever started
+	// lazily, so closeSignal lazily creates the channel too.
+	closeChOnce sync.Once
+	closeCh     chan struct{}
+	closeOnce   sync.Once
+}
+
+const (
+	defaultAckTimeout      = 30 * time.Second
+	defaultAckPollInterval = time.Second
+)
+
+// hecAckResponse is the body Splunk HEC returns for a POST to
+// /services/collector when indexer acknowledgment is requested.
+type hecAckResponse struct {
+	AckID int64 `json:"ackId"`
+}
+
+// hecAckPollResponse is the body Splunk HEC returns for a POST to
+// /services/collector/ack.
+type hecAckPollResponse struct {
+	Acks map[string]bool `json:"acks"`
+}
+
+// channel lazily generates and returns the GUID used to identify this
+// client's requests to the HEC indexer acknowledgment endpoints.
+func (hec *hecClient) channel() string {
+	hec.channelOnce.Do(func() {
+		hec.channelID = uuid.NewV4().String()
+	})
+	return hec.channelID
+}
+
+// ackURL derives the indexer acknowledgment polling endpoint from the
+// configured collector URL.
+func (hec *hecClient) ackURL() string {
+	return strings.TrimSuffix(hec.url, "/") + "/ack"
+}
+
+// closeSignal lazily creates the channel that Close closes to tell the ack
+// poller and spool replay goroutines to stop.
+func (hec *hecClient) closeSignal() chan struct{} {
+	hec.closeChOnce.Do(func() {
+		hec.closeCh = make(chan struct{})
+	})
+	return hec.closeCh
+}
+
+// Close stops any background goroutines this hecClient has started - the
+// indexer-acknowledgment poller and the spool replay loop - so neither
+// outlives the container whose logs it was shipping. It is safe to call
+// even if no background goroutine was ever started, and safe to call more
+// than once. The per-container logger must call this from its own Close.
+func (hec *hecClient) Close() {
+	hec.closeOnce.Do(func() {
+		close(hec.closeSignal())
+	})
+}
+
+// bufferPool recycles the *bytes.Buffer used to build each HEC request body,
+// avoiding a fresh allocation on every postMessagesFrequency tick.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	bufferPool.Put(buf)
+}
+
+// logDroppedMessages is the last-resort fallback for messages that could
+// not be sent and could not be spooled: print each one to the daemon log
+// so it isn't lost without a trace.
+func logDroppedMessages(messages []*splunkMessage) {
+	for _, message := range messages {
+		if jsonEvent, err := json.Marshal(message); err != nil {
+			logrus.Error(err)
+		} else {
+			logrus.Error(fmt.Errorf("Failed to send a message '%s'", string(jsonEvent)))
+		}
+	}
 }
 
 func (hec *hecClient) postMessages(messages []*splunkMessage, lastChance bool) []*splunkMessage {
+	hec.maybeStartSpoolReplay()
 	logrus.Infof("Received %d messages.", len(messages))
 	messagesLen := len(messages)
 	for i := 0; i < messagesLen; i += hec.postMessagesBatchSize {
@@ -62,15 +172,21 @@ func (hec *hecClient) postMessages(messages []*splunkMessage, lastChance bool) [
 				if lastChance {
 					upperBound = messagesLen
 				}
-				// Not all sent, but buffer has got to its maximum, let's log all messages
-				// we could not send and return buffer minus one batch size
-				for j := i; j < upperBound; j++ {
-					if jsonEvent, err := json.Marshal(messages[j]); err != nil {
-						logrus.Error(err)
+				// Not all sent, but buffer has got to its maximum. Spool the
+				// overflow to disk for later replay if configured, otherwise
+				// fall back to logging everything we could not send.
+				spooled := false
+				if spl := hec.getSpool(); spl != nil {
+					if serr := spl.write(messages[i:upperBound]); serr != nil {
+						logrus.Error(serr)
 					} else {
-						logrus.Error(fmt.Errorf("Failed to send a message '%s'", string(jsonEvent)))
+						logrus.Infof("Spooled %d messages to disk for later replay", upperBound-i)
+						spooled = true
 					}
 				}
+				if !spooled {
+					logDroppedMessages(messages[i:upperBound])
+				}
 				return messages[upperBound:messagesLen]
 			}
 			// Not all sent, returning buffer from where we have not sent messages
@@ -89,20 +205,15 @@ func (hec *hecClient) tryPostMessages(messages []*splunkMessage) error {
 		return nil
 	}
 	logrus.Infof("Posint %d messages", len(messages))
-	var buffer bytes.Buffer
-	var writer io.Writer
-	var gzipWriter *gzip.Writer
-	var err error
-	// If gzip compression is enabled - create gzip writer with specified compression
-	// level. If gzip compression is disabled, use standard buffer as a writer
-	if hec.gzipCompression {
-		gzipWriter, err = gzip.NewWriterLevel(&buffer, hec.gzipCompressionLevel)
-		if err != nil {
-			return err
-		}
-		writer = gzipWriter
-	} else {
-		writer = &buffer
+	buffer := getBuffer()
+	defer putBuffer(buffer)
+	codec, err := codecForOption(hec.compression, hec.gzipCompression, hec.gzipCompressionLevel)
+	if err != nil {
+		return err
+	}
+	writer, err := codec.NewWriter(buffer)
+	if err != nil {
+		return err
 	}
 	for _, message := range messages {
 		jsonEvent, err := json.Marshal(message)
@@ -113,12 +224,8 @@ func (hec *hecClient) tryPostMessages(messages []*splunkMessage) error {
 			return err
 		}
 	}
-	// If gzip compression is enabled, tell it, that we are done
-	if hec.gzipCompression {
-		err = gzipWriter.Close()
-		if err != nil {
-			return err
-		}
+	if err := writer.Close(); err != nil {
+		return err
 	}
 	req, err := http.NewRequest("POST", hec.url, bytes.NewBuffer(buffer.Bytes()))
 	if err != nil {
@@ -126,9 +233,12 @@ func (hec *hecClient) tryPostMessages(messages []*splunkMessage) error {
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", hec.auth)
-	// Tell if we are sending gzip compressed body
-	if hec.gzipCompression {
-		req.Header.Set("Content-Encoding", "gzip")
+	// Tell the indexer which codec the body is compressed with, if any
+	if name := codec.Name(); name != "none" {
+		req.Header.Set("Content-Encoding", name)
+	}
+	if hec.indexAckEnabled {
+		req.Header.Set("X-Splunk-Request-Channel", hec.channel())
 	}
 	res, err := hec.client.Do(req)
 	if err != nil {
@@ -143,10 +253,186 @@ func (hec *hecClient) tryPostMessages(messages []*splunkMessage) error {
 		}
 		return fmt.Errorf("%s: failed to send event - %s - %s", driverName, res.Status, body)
 	}
-	io.Copy(ioutil.Discard, res.Body)
+	if !hec.indexAckEnabled {
+		io.Copy(ioutil.Discard, res.Body)
+		return nil
+	}
+	var ackRes hecAckResponse
+	if err := json.NewDecoder(res.Body).Decode(&ackRes); err != nil {
+		return fmt.Errorf("%s: failed to decode ack response - %v", driverName, err)
+	}
+	return hec.waitForAck(ackRes.AckID)
+}
+
+// waitForAck blocks until ackID has been confirmed by the background
+// poller started by startAckPoller, or returns an error once ackTimeout
+// elapses.
+func (hec *hecClient) waitForAck(ackID int64) error {
+	hec.ackTrackerOnce.Do(func() {
+		hec.ackTracker = newAckTracker()
+	})
+	hec.startAckPoller()
+	done := hec.ackTracker.await(ackID)
+	timeout := hec.ackTimeout
+	if timeout <= 0 {
+		timeout = defaultAckTimeout
+	}
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		hec.ackTracker.forget(ackID)
+		return fmt.Errorf("%s: timed out waiting for ack %d", driverName, ackID)
+	}
+}
+
+// startAckPoller launches the background goroutine that polls
+// /services/collector/ack for all outstanding ack IDs. It only ever runs
+// once per hecClient.
+func (hec *hecClient) startAckPoller() {
+	hec.ackPollOnce.Do(func() {
+		interval := hec.ackPollInterval
+		if interval <= 0 {
+			interval = defaultAckPollInterval
+		}
+		go hec.pollAcks(interval)
+	})
+}
+
+func (hec *hecClient) pollAcks(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	done := hec.closeSignal()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			ackIDs := hec.ackTracker.outstanding()
+			if len(ackIDs) == 0 {
+				continue
+			}
+			if err := hec.pollAcksOnce(ackIDs); err != nil {
+				logrus.Error(err)
+			}
+		}
+	}
+}
+
+func (hec *hecClient) pollAcksOnce(ackIDs []int64) error {
+	body, err := json.Marshal(struct {
+		Acks []int64 `json:"acks"`
+	}{Acks: ackIDs})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", hec.ackURL(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", hec.auth)
+	req.Header.Set("X-Splunk-Request-Channel", hec.channel())
+	res, err := hec.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("%s: failed to poll acks - %s - %s", driverName, res.Status, body)
+	}
+	var pollRes hecAckPollResponse
+	if err := json.NewDecoder(res.Body).Decode(&pollRes); err != nil {
+		return fmt.Errorf("%s: failed to decode ack poll response - %v", driverName, err)
+	}
+	var confirmed []int64
+	for idStr, acked := range pollRes.Acks {
+		if !acked {
+			continue
+		}
+		var id int64
+		if _, err := fmt.Sscanf(idStr, "%d", &id); err != nil {
+			continue
+		}
+		confirmed = append(confirmed, id)
+	}
+	hec.ackTracker.confirm(confirmed)
 	return nil
 }
 
+const spoolReplayInterval = 30 * time.Second
+
+// getSpool lazily constructs the on-disk overflow spool once
+// splunk-spool-path has been configured, and returns nil otherwise.
+func (hec *hecClient) getSpool() *spool {
+	if hec.spoolPath == "" {
+		return nil
+	}
+	hec.spoolOnce.Do(func() {
+		hec.spoolInstance = newSpool(hec.spoolPath, hec.spoolMaxBytes)
+	})
+	return hec.spoolInstance
+}
+
+// maybeStartSpoolReplay starts the background goroutine that drains the
+// spool back through tryPostMessages once HEC recovers. It is a no-op if
+// no spool path is configured, and only ever starts the goroutine once.
+func (hec *hecClient) maybeStartSpoolReplay() {
+	spl := hec.getSpool()
+	if spl == nil {
+		return
+	}
+	hec.spoolReplayRun.Do(func() {
+		go hec.replaySpool(spl)
+	})
+}
+
+func (hec *hecClient) replaySpool(spl *spool) {
+	ticker := time.NewTicker(spoolReplayInterval)
+	defer ticker.Stop()
+	done := hec.closeSignal()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := hec.replaySpoolOnce(spl); err != nil {
+				logrus.Error(err)
+			}
+		}
+	}
+}
+
+// replaySpoolOnce replays every spooled batch through tryPostMessages, in
+// the order they were spooled, then consumes only the bytes it actually
+// replayed - so a batch spooled by a concurrent postMessages call while
+// replay was in flight is never mistaken for one that was sent. It stops
+// at (and keeps) the first batch that still fails to send, so a
+// prolonged outage doesn't spin.
+func (hec *hecClient) replaySpoolOnce(spl *spool) error {
+	records, err := spl.readAllWithOffsets()
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	var consumed int64
+	for _, rec := range records {
+		if err := hec.tryPostMessages(rec.messages); err != nil {
+			logrus.Error(err)
+			break
+		}
+		consumed = rec.offset
+	}
+	if consumed == 0 {
+		return nil
+	}
+	logrus.Infof("Replayed spooled batches up to offset %d", consumed)
+	return spl.consume(consumed)
+}
+
 func (hec *hecClient) verifySplunkConnection(l *splunkLogger) error {
 	req, err := http.NewRequest(http.MethodGet, hec.healthCheckURL, nil)
 	if err != nil {
@@ -0,0 +1,325 @@
+/*
+ * Copyright 2018 Splunk, Inc..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/Teku-Group/docker-logging-plugin/hectest"
+)
+
+const testToken = "test-token"
+
+func newTestHecClient(url string) *hecClient {
+	return &hecClient{
+		client:                http.DefaultClient,
+		url:                   url,
+		auth:                  "Splunk " + testToken,
+		postMessagesBatchSize: 10,
+		bufferMaximum:         100,
+	}
+}
+
+func testMessages(n int) []*splunkMessage {
+	messages := make([]*splunkMessage, n)
+	for i := range messages {
+		messages[i] = &splunkMessage{Event: "test event"}
+	}
+	return messages
+}
+
+func TestTryPostMessagesBatchingBoundary(t *testing.T) {
+	srv := hectest.New(testToken)
+	defer srv.Close()
+
+	hec := newTestHecClient(srv.CollectorURL())
+
+	cases := []struct {
+		name    string
+		count   int
+		batches int
+	}{
+		{"single message", 1, 1},
+		{"exact batch", 10, 1},
+		{"batch plus one", 11, 2},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv.FailNext(0)
+			before := len(srv.Batches())
+			remaining := hec.postMessages(testMessages(c.count), false)
+			if len(remaining) != 0 {
+				t.Fatalf("expected all messages to be sent, %d left over", len(remaining))
+			}
+			if got := len(srv.Batches()) - before; got != c.batches {
+				t.Fatalf("expected %d batches, got %d", c.batches, got)
+			}
+		})
+	}
+}
+
+func TestTryPostMessagesGzipRoundTrip(t *testing.T) {
+	srv := hectest.New(testToken)
+	defer srv.Close()
+
+	hec := newTestHecClient(srv.CollectorURL())
+	hec.gzipCompression = true
+	hec.gzipCompressionLevel = -1 // gzip.DefaultCompression
+
+	if err := hec.tryPostMessages(testMessages(5)); err != nil {
+		t.Fatalf("tryPostMessages failed: %v", err)
+	}
+	if got := len(srv.Events()); got != 5 {
+		t.Fatalf("expected 5 events recorded, got %d", got)
+	}
+}
+
+func TestTryPostMessagesHTTPFailureIsRetried(t *testing.T) {
+	srv := hectest.New(testToken)
+	defer srv.Close()
+	srv.FailNext(1)
+
+	hec := newTestHecClient(srv.CollectorURL())
+	hec.bufferMaximum = 100
+
+	if err := hec.tryPostMessages(testMessages(3)); err == nil {
+		t.Fatal("expected tryPostMessages to fail on a 503")
+	}
+	if got := len(srv.Events()); got != 0 {
+		t.Fatalf("expected no events recorded on failure, got %d", got)
+	}
+
+	if err := hec.tryPostMessages(testMessages(3)); err != nil {
+		t.Fatalf("expected retry to succeed, got %v", err)
+	}
+	if got := len(srv.Events()); got != 3 {
+		t.Fatalf("expected 3 events recorded after retry, got %d", got)
+	}
+}
+
+func TestPostMessagesDropsBatchAtBufferMaximum(t *testing.T) {
+	srv := hectest.New(testToken)
+	defer srv.Close()
+	srv.FailNext(1000)
+
+	hec := newTestHecClient(srv.CollectorURL())
+	hec.postMessagesBatchSize = 5
+	hec.bufferMaximum = 5
+
+	remaining := hec.postMessages(testMessages(5), false)
+	if len(remaining) != 0 {
+		t.Fatalf("expected dropped batch to leave no messages behind, got %d", len(remaining))
+	}
+}
+
+func TestPostMessagesLastChanceDropsEverything(t *testing.T) {
+	srv := hectest.New(testToken)
+	defer srv.Close()
+	srv.FailNext(1000)
+
+	hec := newTestHecClient(srv.CollectorURL())
+	hec.postMessagesBatchSize = 5
+	hec.bufferMaximum = 1000
+
+	remaining := hec.postMessages(testMessages(5), true)
+	if len(remaining) != 0 {
+		t.Fatalf("expected lastChance to drop all messages, got %d", len(remaining))
+	}
+}
+
+func TestVerifySplunkConnectionHealthCheck(t *testing.T) {
+	srv := hectest.New(testToken)
+	defer srv.Close()
+
+	hec := newTestHecClient(srv.CollectorURL())
+	hec.healthCheckURL = srv.HealthURL()
+
+	if err := hec.verifySplunkConnection(nil); err != nil {
+		t.Fatalf("expected healthy server, got %v", err)
+	}
+
+	srv.SetHealthStatus(http.StatusServiceUnavailable)
+	if err := hec.verifySplunkConnection(nil); err == nil {
+		t.Fatal("expected verifySplunkConnection to fail when health check returns 503")
+	}
+}
+
+// settledGoroutines lets ticker-driven goroutines started in a prior step
+// actually exit before we sample runtime.NumGoroutine, instead of racing
+// their teardown.
+func settledGoroutines(t *testing.T) int {
+	t.Helper()
+	runtime.Gosched()
+	time.Sleep(50 * time.Millisecond)
+	runtime.GC()
+	return runtime.NumGoroutine()
+}
+
+func TestAckPollerStopsOnClose(t *testing.T) {
+	hec := newTestHecClient("http://example.invalid/services/collector")
+	hec.indexAckEnabled = true
+	hec.ackPollInterval = time.Millisecond
+
+	before := settledGoroutines(t)
+
+	hec.ackTrackerOnce.Do(func() { hec.ackTracker = newAckTracker() })
+	hec.startAckPoller()
+
+	during := settledGoroutines(t)
+	if during <= before {
+		t.Fatalf("expected ack poller goroutine to be running, got %d (was %d before start)", during, before)
+	}
+
+	hec.Close()
+
+	after := settledGoroutines(t)
+	if after > before {
+		t.Fatalf("expected ack poller goroutine to exit after Close, got %d goroutines (started at %d)", after, before)
+	}
+}
+
+func TestTryPostMessagesSlowResponse(t *testing.T) {
+	srv := hectest.New(testToken)
+	defer srv.Close()
+	srv.SetSlowResponse(50 * time.Millisecond)
+
+	hec := newTestHecClient(srv.CollectorURL())
+	if err := hec.tryPostMessages(testMessages(1)); err != nil {
+		t.Fatalf("tryPostMessages failed: %v", err)
+	}
+}
+
+func TestTryPostMessagesAckConfirmedBeforeTimeout(t *testing.T) {
+	srv := hectest.New(testToken)
+	defer srv.Close()
+
+	hec := newTestHecClient(srv.CollectorURL())
+	defer hec.Close()
+	hec.indexAckEnabled = true
+	hec.ackPollInterval = 5 * time.Millisecond
+	hec.ackTimeout = time.Second
+
+	if err := hec.tryPostMessages(testMessages(3)); err != nil {
+		t.Fatalf("tryPostMessages failed: %v", err)
+	}
+	if got := len(srv.Events()); got != 3 {
+		t.Fatalf("expected 3 events recorded, got %d", got)
+	}
+}
+
+func TestAckTimeoutFallsThroughToBufferMaximum(t *testing.T) {
+	srv := hectest.New(testToken)
+	defer srv.Close()
+	srv.AutoAck(false) // the indexer never confirms, so waitForAck must time out
+
+	hec := newTestHecClient(srv.CollectorURL())
+	defer hec.Close()
+	hec.indexAckEnabled = true
+	hec.ackTimeout = 20 * time.Millisecond
+	hec.ackPollInterval = 5 * time.Millisecond
+	hec.postMessagesBatchSize = 5
+	hec.bufferMaximum = 5
+
+	remaining := hec.postMessages(testMessages(5), false)
+	if len(remaining) != 0 {
+		t.Fatalf("expected dropped batch to leave no messages behind, got %d", len(remaining))
+	}
+	// The events reached the indexer over HTTP; only the ack never arrived,
+	// so this exercises the ack-timeout path specifically rather than an
+	// HTTP failure falling through to the same bufferMaximum drop.
+	if got := len(srv.Events()); got != 5 {
+		t.Fatalf("expected the batch to have been delivered despite the missing ack, got %d events", got)
+	}
+}
+
+func TestAckPollerConfirmsMultipleOutstandingIDs(t *testing.T) {
+	srv := hectest.New(testToken)
+	defer srv.Close()
+	srv.AutoAck(false)
+
+	hec := newTestHecClient(srv.CollectorURL())
+	defer hec.Close()
+	hec.indexAckEnabled = true
+	hec.ackPollInterval = 5 * time.Millisecond
+	hec.ackTimeout = 500 * time.Millisecond
+
+	const n = 3
+	errCh := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			errCh <- hec.tryPostMessages(testMessages(1))
+		}()
+	}
+
+	// Let every goroutine post and start waiting on its own ack ID before
+	// acknowledging any of them, so all n ack IDs are outstanding at once
+	// and the poller has to track and confirm several of them together.
+	time.Sleep(20 * time.Millisecond)
+	for id := int64(1); id <= n; id++ {
+		srv.Ack(id)
+	}
+
+	for i := 0; i < n; i++ {
+		if err := <-errCh; err != nil {
+			t.Fatalf("tryPostMessages failed: %v", err)
+		}
+	}
+	if got := len(srv.Events()); got != n {
+		t.Fatalf("expected %d events recorded, got %d", n, got)
+	}
+}
+
+// benchmarkTryPostMessages drives tryPostMessages at the given gzip level
+// so BenchmarkTryPostMessagesPooled and BenchmarkTryPostMessagesUnpooled
+// can be compared with -benchmem: gzip.DefaultCompression is the only
+// level gzipWriterPool recycles, so the two report the allocation
+// reduction the pooling was added for.
+func benchmarkTryPostMessages(b *testing.B, level int) {
+	srv := hectest.New(testToken)
+	defer srv.Close()
+
+	hec := newTestHecClient(srv.CollectorURL())
+	hec.gzipCompression = true
+	hec.gzipCompressionLevel = level
+	messages := testMessages(50)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := hec.tryPostMessages(messages); err != nil {
+			b.Fatalf("tryPostMessages failed: %v", err)
+		}
+	}
+}
+
+// BenchmarkTryPostMessagesPooled exercises the gzip.DefaultCompression
+// path, where NewWriter is served from gzipWriterPool instead of
+// allocating a fresh *gzip.Writer every call.
+func BenchmarkTryPostMessagesPooled(b *testing.B) {
+	benchmarkTryPostMessages(b, gzip.DefaultCompression)
+}
+
+// BenchmarkTryPostMessagesUnpooled exercises a non-default compression
+// level, which gzip.Writer can't change on Reset, so codec.NewWriter falls
+// back to gzip.NewWriterLevel on every call instead of reusing the pool.
+func BenchmarkTryPostMessagesUnpooled(b *testing.B) {
+	benchmarkTryPostMessages(b, gzip.BestSpeed)
+}
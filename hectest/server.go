@@ -0,0 +1,287 @@
+/*
+ * Copyright 2018 Splunk, Inc..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package hectest provides an in-memory Splunk HEC server for exercising
+// hecClient without a real Splunk instance. It implements just enough of
+// the HEC contract - token auth, gzip bodies, concatenated JSON events, the
+// health-check endpoint, and indexer acknowledgment (/services/collector/ack)
+// - to drive postMessages/tryPostMessages in tests, plus hooks to simulate
+// the failure modes their retry logic handles.
+package hectest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Server is an httptest.Server that understands the subset of the Splunk
+// HEC protocol that hecClient speaks.
+type Server struct {
+	*httptest.Server
+
+	token string
+
+	mu           sync.Mutex
+	batches      [][]json.RawMessage
+	healthStatus int
+	failNext     int
+	slow         time.Duration
+	onBatch      func(events []json.RawMessage) bool
+
+	// Indexer acknowledgment
+	nextAckID int64
+	autoAck   bool
+	acked     map[int64]bool
+}
+
+// New starts a Server that accepts the given HEC token. Call Close when
+// done with it.
+func New(token string) *Server {
+	s := &Server{
+		token:        token,
+		healthStatus: http.StatusOK,
+		nextAckID:    1,
+		autoAck:      true,
+		acked:        make(map[int64]bool),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/services/collector", s.handleCollector)
+	mux.HandleFunc("/services/collector/ack", s.handleAck)
+	mux.HandleFunc("/services/collector/health", s.handleHealth)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// CollectorURL is the URL hecClient.url should be set to.
+func (s *Server) CollectorURL() string {
+	return s.URL + "/services/collector"
+}
+
+// HealthURL is the URL hecClient.healthCheckURL should be set to.
+func (s *Server) HealthURL() string {
+	return s.URL + "/services/collector/health"
+}
+
+// Events returns every event recorded across all batches received so far,
+// in arrival order.
+func (s *Server) Events() []json.RawMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var all []json.RawMessage
+	for _, batch := range s.batches {
+		all = append(all, batch...)
+	}
+	return all
+}
+
+// Batches returns the events grouped by the POST request that delivered
+// them, letting tests assert on batching boundaries.
+func (s *Server) Batches() [][]json.RawMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]json.RawMessage(nil), s.batches...)
+}
+
+// FailNext makes the next n POSTs to /services/collector fail with a 503,
+// simulating a HEC outage.
+func (s *Server) FailNext(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failNext = n
+}
+
+// SetSlowResponse delays every subsequent POST to /services/collector by
+// d before responding, simulating a slow or overloaded indexer.
+func (s *Server) SetSlowResponse(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.slow = d
+}
+
+// SetHealthStatus overrides the status code returned by the health-check
+// endpoint, e.g. to simulate verifySplunkConnection failing.
+func (s *Server) SetHealthStatus(code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.healthStatus = code
+}
+
+// OnBatch installs a hook invoked with every decoded batch of events
+// before it is recorded. Returning true fails that batch with a 503
+// instead of accepting it, simulating a partial failure.
+func (s *Server) OnBatch(fn func(events []json.RawMessage) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onBatch = fn
+}
+
+// AutoAck controls whether ack IDs issued by /services/collector are
+// immediately reported as acknowledged by /services/collector/ack. It
+// defaults to true; tests exercising indexer acknowledgment set it false
+// to hold an ack pending until Ack is called, simulating a slow or stuck
+// indexer.
+func (s *Server) AutoAck(auto bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.autoAck = auto
+}
+
+// Ack marks ackID as acknowledged, so the next /services/collector/ack
+// poll reports it as true.
+func (s *Server) Ack(ackID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acked[ackID] = true
+}
+
+func (s *Server) handleCollector(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mu.Lock()
+	if s.failNext > 0 {
+		s.failNext--
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	slow := s.slow
+	s.mu.Unlock()
+	if slow > 0 {
+		time.Sleep(slow)
+	}
+
+	if r.Header.Get("Authorization") != "Splunk "+s.token {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	body, err := decodeBody(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	events, err := splitEvents(body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	onBatch := s.onBatch
+	s.mu.Unlock()
+
+	// Run the hook without holding s.mu so it is free to call back into
+	// Events/Batches/etc. without deadlocking.
+	if onBatch != nil && onBatch(events) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	s.mu.Lock()
+	s.batches = append(s.batches, events)
+	ackID := s.nextAckID
+	s.nextAckID++
+	if s.autoAck {
+		s.acked[ackID] = true
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		AckID int64 `json:"ackId"`
+	}{AckID: ackID})
+}
+
+// handleAck serves /services/collector/ack, reporting true for every
+// requested ack ID that has been marked acknowledged (immediately, via
+// AutoAck, or explicitly via Ack) and false otherwise.
+func (s *Server) handleAck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get("Authorization") != "Splunk "+s.token {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		Acks []int64 `json:"acks"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	acks := make(map[string]bool, len(req.Acks))
+	for _, id := range req.Acks {
+		acks[strconv.FormatInt(id, 10)] = s.acked[id]
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Acks map[string]bool `json:"acks"`
+	}{Acks: acks})
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	status := s.healthStatus
+	s.mu.Unlock()
+	w.WriteHeader(status)
+}
+
+// decodeBody returns r's body, transparently gunzipping it if
+// Content-Encoding is gzip. Any other encoding is returned as received.
+func decodeBody(r *http.Request) ([]byte, error) {
+	defer r.Body.Close()
+	if r.Header.Get("Content-Encoding") != "gzip" {
+		return ioutil.ReadAll(r.Body)
+	}
+	gz, err := gzip.NewReader(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	return ioutil.ReadAll(gz)
+}
+
+// splitEvents splits a HEC body of back-to-back JSON event objects into
+// its individual events.
+func splitEvents(raw []byte) ([]json.RawMessage, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	var events []json.RawMessage
+	for dec.More() {
+		var event json.RawMessage
+		if err := dec.Decode(&event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
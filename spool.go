@@ -0,0 +1,371 @@
+/*
+ * Copyright 2018 Splunk, Inc..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// spoolRecordHeaderLen is the size, in bytes, of the length-prefix and
+// checksum that precede each gzip-compressed record in a spool file.
+const spoolRecordHeaderLen = 12
+
+// spool is a crash-safe, size-bounded on-disk queue of message batches
+// that postMessages could not deliver even after exhausting bufferMaximum.
+// Each record is a gzip-compressed JSON-encoded batch, framed with a
+// length prefix and a CRC32 checksum so a torn write from a crash can be
+// detected and discarded instead of corrupting the whole file.
+type spool struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+}
+
+// spoolRecord is one decoded batch together with the byte offset in the
+// spool file immediately following it, so callers can consume a prefix of
+// the file without disturbing anything appended after it was read.
+type spoolRecord struct {
+	messages []*splunkMessage
+	offset   int64
+}
+
+func newSpool(path string, maxBytes int64) *spool {
+	return &spool{path: path, maxBytes: maxBytes}
+}
+
+// write appends messages as a single spool record, fsyncing before
+// returning, then evicts the oldest records if that pushed the spool over
+// maxBytes.
+func (s *spool) write(messages []*splunkMessage) error {
+	record, err := encodeSpoolRecord(messages)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, writeErr := f.Write(record)
+	syncErr := f.Sync()
+	closeErr := f.Close()
+	if writeErr != nil {
+		return writeErr
+	}
+	if syncErr != nil {
+		return syncErr
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return s.evictLocked()
+}
+
+// readAll reads every intact record in the spool, in the order they were
+// written. A torn or corrupt record - expected after a crash mid-write -
+// ends decoding early; everything read before it is still returned.
+func (s *spool) readAll() ([][]*splunkMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records, err := s.readAllLocked()
+	if err != nil {
+		return nil, err
+	}
+	return recordMessages(records), nil
+}
+
+// readAllWithOffsets is like readAll, but also returns each record's
+// ending byte offset so a caller can later consume() just the prefix it
+// has processed, even if more records were appended in the meantime.
+func (s *spool) readAllWithOffsets() ([]spoolRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readAllLocked()
+}
+
+// consume permanently removes the leading offset bytes of the spool file,
+// as previously reported by readAllWithOffsets, leaving anything written
+// after that point (including batches spooled concurrently) intact.
+func (s *spool) consume(offset int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.consumeLocked(offset)
+}
+
+// rewrite atomically replaces the spool's contents with records,
+// discarding everything currently on disk. Passing a nil or empty slice
+// removes the spool file entirely.
+func (s *spool) rewrite(records [][]*splunkMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rewriteLocked(records)
+}
+
+func (s *spool) readAllLocked() ([]spoolRecord, error) {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	fileSize := info.Size()
+
+	var records []spoolRecord
+	var offset int64
+	var corrupt bool
+	r := bufio.NewReader(f)
+	for {
+		header := make([]byte, spoolRecordHeaderLen)
+		n, err := io.ReadFull(r, header)
+		offset += int64(n)
+		if err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				return records, err
+			}
+			// A partial header is a torn write, not a clean end of file.
+			if err == io.ErrUnexpectedEOF {
+				logrus.Warnf("%s: truncated spool record header, discarding corrupt tail", driverName)
+				corrupt = true
+			}
+			break
+		}
+		length := binary.BigEndian.Uint64(header[0:8])
+		checksum := binary.BigEndian.Uint32(header[8:12])
+
+		// A torn write can leave a header claiming a length that runs
+		// past the end of the file; bail out before attempting an
+		// allocation sized off a potentially garbage value.
+		if int64(length) > fileSize-offset {
+			logrus.Warnf("%s: spool record length exceeds remaining file size, discarding corrupt tail", driverName)
+			corrupt = true
+			break
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			logrus.Warnf("%s: truncated spool record, discarding corrupt tail", driverName)
+			corrupt = true
+			break
+		}
+		offset += int64(length)
+		if crc32.ChecksumIEEE(payload) != checksum {
+			logrus.Warnf("%s: spool record failed checksum, discarding corrupt tail", driverName)
+			corrupt = true
+			break
+		}
+		messages, err := decodeSpoolPayload(payload)
+		if err != nil {
+			logrus.Warnf("%s: spool record failed to decode, discarding corrupt tail: %v", driverName, err)
+			corrupt = true
+			break
+		}
+		records = append(records, spoolRecord{messages: messages, offset: offset})
+	}
+
+	// A corrupt tail was only ever skipped in memory: write() always
+	// appends, and consumeLocked raw-copies everything past its offset,
+	// so left on disk it would reappear on every future read and
+	// permanently wall off any record written after it. Re-encode just
+	// the good prefix back to disk now, while we still have it decoded.
+	if corrupt {
+		f.Close()
+		if err := s.rewriteLocked(recordMessages(records)); err != nil {
+			return records, err
+		}
+	}
+	return records, nil
+}
+
+func (s *spool) consumeLocked(offset int64) error {
+	if offset <= 0 {
+		return nil
+	}
+	f, err := os.Open(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	_, copyErr := io.Copy(tmp, f)
+	f.Close()
+	if copyErr != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return copyErr
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
+
+func (s *spool) rewriteLocked(records [][]*splunkMessage) error {
+	if len(records) == 0 {
+		if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	tmpPath := s.path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	for _, messages := range records {
+		record, err := encodeSpoolRecord(messages)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if _, err := f.Write(record); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
+
+// evictLocked drops the oldest spool records, oldest-first, until the
+// spool is back under maxBytes. A maxBytes of zero or less means
+// unbounded.
+func (s *spool) evictLocked() error {
+	if s.maxBytes <= 0 {
+		return nil
+	}
+	info, err := os.Stat(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if info.Size() <= s.maxBytes {
+		return nil
+	}
+
+	records, err := s.readAllLocked()
+	if err != nil {
+		return err
+	}
+
+	var prevOffset, total int64
+	sizes := make([]int64, len(records))
+	for i, rec := range records {
+		sizes[i] = rec.offset - prevOffset
+		prevOffset = rec.offset
+	}
+	total = prevOffset
+
+	idx := 0
+	for total > s.maxBytes && idx < len(records) {
+		total -= sizes[idx]
+		idx++
+		logrus.Warnf("%s: spool exceeded %d bytes, evicting oldest batch", driverName, s.maxBytes)
+	}
+	return s.rewriteLocked(recordMessages(records[idx:]))
+}
+
+func recordMessages(records []spoolRecord) [][]*splunkMessage {
+	if len(records) == 0 {
+		return nil
+	}
+	out := make([][]*splunkMessage, len(records))
+	for i, rec := range records {
+		out[i] = rec.messages
+	}
+	return out
+}
+
+func encodeSpoolRecord(messages []*splunkMessage) ([]byte, error) {
+	raw, err := json.Marshal(messages)
+	if err != nil {
+		return nil, err
+	}
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	if _, err := gz.Write(raw); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	header := make([]byte, spoolRecordHeaderLen)
+	binary.BigEndian.PutUint64(header[0:8], uint64(compressed.Len()))
+	binary.BigEndian.PutUint32(header[8:12], crc32.ChecksumIEEE(compressed.Bytes()))
+	return append(header, compressed.Bytes()...), nil
+}
+
+func decodeSpoolPayload(payload []byte) ([]*splunkMessage, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	raw, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return nil, err
+	}
+	var messages []*splunkMessage
+	if err := json.Unmarshal(raw, &messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
@@ -0,0 +1,283 @@
+/*
+ * Copyright 2018 Splunk, Inc..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Teku-Group/docker-logging-plugin/hectest"
+)
+
+func spoolMessages(event string, n int) []*splunkMessage {
+	messages := make([]*splunkMessage, n)
+	for i := range messages {
+		messages[i] = &splunkMessage{Event: event}
+	}
+	return messages
+}
+
+func TestSpoolWriteReadAllRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool")
+	s := newSpool(path, 0)
+
+	if err := s.write(spoolMessages("first", 2)); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if err := s.write(spoolMessages("second", 3)); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	records, err := s.readAll()
+	if err != nil {
+		t.Fatalf("readAll failed: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+	if len(records[0]) != 2 || records[0][0].Event != "first" {
+		t.Fatalf("unexpected first record: %+v", records[0])
+	}
+	if len(records[1]) != 3 || records[1][0].Event != "second" {
+		t.Fatalf("unexpected second record: %+v", records[1])
+	}
+}
+
+func TestSpoolRewriteEmptyRemovesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool")
+	s := newSpool(path, 0)
+
+	if err := s.write(spoolMessages("event", 1)); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if err := s.rewrite(nil); err != nil {
+		t.Fatalf("rewrite failed: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected spool file to be removed, stat err = %v", err)
+	}
+
+	records, err := s.readAll()
+	if err != nil {
+		t.Fatalf("readAll on missing spool failed: %v", err)
+	}
+	if len(records) != 0 {
+		t.Fatalf("expected no records, got %d", len(records))
+	}
+}
+
+func TestSpoolSkipsCorruptTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool")
+	s := newSpool(path, 0)
+
+	if err := s.write(spoolMessages("good", 1)); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatalf("failed to open spool for corruption: %v", err)
+	}
+	if _, err := f.Write([]byte{0, 0, 0, 0, 0, 0, 0, 0xFF, 1, 2, 3, 4, 5}); err != nil {
+		t.Fatalf("failed to append corrupt tail: %v", err)
+	}
+	f.Close()
+
+	records, err := s.readAll()
+	if err != nil {
+		t.Fatalf("readAll should tolerate a corrupt tail, got error: %v", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("expected the one intact record to survive, got %d", len(records))
+	}
+}
+
+// TestSpoolTruncatesCorruptTailOnRead verifies that a corrupt tail is
+// removed from disk as soon as it's detected, not just skipped in memory.
+// Without that, write()'s O_APPEND would land every future batch after the
+// still-present garbage, and every future readAll would trip over the same
+// corruption and never reach them - permanently losing anything spooled
+// after a single torn write.
+func TestSpoolTruncatesCorruptTailOnRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool")
+	s := newSpool(path, 0)
+
+	if err := s.write(spoolMessages("good", 1)); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatalf("failed to open spool for corruption: %v", err)
+	}
+	if _, err := f.Write([]byte{0, 0, 0, 0, 0, 0, 0, 0xFF, 1, 2, 3, 4, 5}); err != nil {
+		t.Fatalf("failed to append corrupt tail: %v", err)
+	}
+	f.Close()
+
+	beforeTruncate, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+
+	if _, err := s.readAll(); err != nil {
+		t.Fatalf("readAll should tolerate a corrupt tail, got error: %v", err)
+	}
+
+	afterTruncate, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	if afterTruncate.Size() >= beforeTruncate.Size() {
+		t.Fatalf("expected readAll to truncate the corrupt tail from disk, size was %d, still %d", beforeTruncate.Size(), afterTruncate.Size())
+	}
+
+	if err := s.write(spoolMessages("second", 1)); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	records, err := s.readAll()
+	if err != nil {
+		t.Fatalf("readAll failed: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected both records to survive once the corrupt tail was truncated, got %d", len(records))
+	}
+	if records[0][0].Event != "good" || records[1][0].Event != "second" {
+		t.Fatalf("unexpected records: %+v", records)
+	}
+}
+
+func TestSpoolEvictsOldestFirst(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool")
+
+	// First, write a single batch unconstrained to learn how large one
+	// record is on disk.
+	unbounded := newSpool(path, 0)
+	if err := unbounded.write(spoolMessages("oldest", 20)); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	oneRecordSize := info.Size()
+
+	// A second batch of the same size now pushes the spool past the cap of
+	// a single record, so only the oldest batch should be evicted.
+	s := newSpool(path, oneRecordSize)
+	if err := s.write(spoolMessages("newest", 20)); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	records, err := s.readAll()
+	if err != nil {
+		t.Fatalf("readAll failed: %v", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("expected eviction to leave a single record, got %d", len(records))
+	}
+	if records[0][0].Event != "newest" {
+		t.Fatalf("expected the oldest record to be evicted, got %+v", records[0][0])
+	}
+}
+
+// TestReplaySpoolOnceKeepsConcurrentlySpooledBatch verifies that a batch
+// spooled by postMessages while a replay is in flight survives replay's
+// own bookkeeping, instead of being silently discarded alongside the
+// batches that were actually just replayed.
+func TestReplaySpoolOnceKeepsConcurrentlySpooledBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool")
+	spl := newSpool(path, 0)
+
+	if err := spl.write(spoolMessages("a", 1)); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if err := spl.write(spoolMessages("b", 1)); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	var concurrentWriteErr error
+	srv := hectest.New(testToken)
+	defer srv.Close()
+	srv.OnBatch(func(events []json.RawMessage) bool {
+		// Simulate postMessages spooling a brand new overflow batch while
+		// this replay pass is already in flight.
+		if len(srv.Batches()) == 0 {
+			concurrentWriteErr = spl.write(spoolMessages("concurrent", 1))
+		}
+		return false
+	})
+
+	hec := newTestHecClient(srv.CollectorURL())
+	if err := hec.replaySpoolOnce(spl); err != nil {
+		t.Fatalf("replaySpoolOnce failed: %v", err)
+	}
+	if concurrentWriteErr != nil {
+		t.Fatalf("concurrent write failed: %v", concurrentWriteErr)
+	}
+
+	remaining, err := spl.readAll()
+	if err != nil {
+		t.Fatalf("readAll failed: %v", err)
+	}
+	if len(remaining) != 1 {
+		t.Fatalf("expected the concurrently spooled batch to survive, got %d records", len(remaining))
+	}
+	if remaining[0][0].Event != "concurrent" {
+		t.Fatalf("expected surviving record to be the concurrent batch, got %+v", remaining[0][0])
+	}
+
+	sent := srv.Events()
+	if len(sent) != 2 {
+		t.Fatalf("expected both original batches to be replayed, got %d events", len(sent))
+	}
+}
+
+// TestSpoolReplayStopsOnClose reproduces the leak a maintainer flagged in
+// review: every hecClient with spoolPath set starts replaySpool's ticker
+// goroutine on its first postMessages call and never stopped it, so a host
+// cycling containers through this plugin would accumulate one leaked
+// goroutine per container for the life of the daemon.
+func TestSpoolReplayStopsOnClose(t *testing.T) {
+	before := settledGoroutines(t)
+
+	const n = 5
+	clients := make([]*hecClient, n)
+	for i := 0; i < n; i++ {
+		hec := newTestHecClient("http://example.invalid/services/collector")
+		hec.spoolPath = filepath.Join(t.TempDir(), "spool")
+		hec.maybeStartSpoolReplay()
+		clients[i] = hec
+	}
+
+	during := settledGoroutines(t)
+	if during < before+n {
+		t.Fatalf("expected %d replaySpool goroutines running, got %d (was %d before)", n, during, before)
+	}
+
+	for _, hec := range clients {
+		hec.Close()
+	}
+
+	after := settledGoroutines(t)
+	if after > before {
+		t.Fatalf("expected replaySpool goroutines to exit after Close, got %d goroutines (started at %d)", after, before)
+	}
+}